@@ -0,0 +1,82 @@
+// Copyright 2016-2020, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/docker/cli/cli/config"
+	"github.com/docker/cli/cli/config/types"
+	"github.com/docker/docker-credential-helpers/client"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+)
+
+// resolveRegistryCredentials determines the username and password to
+// authenticate to registry with, preferring, in order:
+//
+//  1. An explicit username/password on the resource.
+//  2. A named Docker credential helper (credentialHelper), invoked as
+//     docker-credential-<credentialHelper> the same way the Docker CLI
+//     does, so that short-lived tokens (ECR, GCR, ACR, ...) are minted
+//     fresh on every apply instead of being stored in Pulumi state.
+//  3. The credsStore/credHelpers configured in the ambient
+//     ~/.docker/config.json for registry's server.
+//
+// ok is false if none of the above yield credentials, in which case the
+// registry is assumed to not require authentication.
+func resolveRegistryCredentials(registry resource.PropertyMap) (username, password string, ok bool, err error) {
+	server := registry["server"].StringValue()
+
+	if u, p := registry["username"], registry["password"]; !u.IsNull() && !p.IsNull() {
+		return u.StringValue(), p.StringValue(), true, nil
+	}
+
+	if helper := registry["credentialHelper"]; !helper.IsNull() {
+		program := client.NewShellProgramFunc("docker-credential-" + helper.StringValue())
+		creds, err := client.Get(program, server)
+		if err != nil {
+			return "", "", false, fmt.Errorf("resolving credentials from docker-credential-%s: %w", helper.StringValue(), err)
+		}
+		return creds.Username, creds.Secret, true, nil
+	}
+
+	authConfig, err := config.LoadDefaultConfigFile(os.Stderr).GetAuthConfig(server)
+	if err != nil {
+		return "", "", false, fmt.Errorf("resolving credentials from docker config: %w", err)
+	}
+	if authConfig.Username == "" && authConfig.Password == "" {
+		return "", "", false, nil
+	}
+	return authConfig.Username, authConfig.Password, true, nil
+}
+
+// storeRegistryCredentials persists username/password for server into the
+// same credential store (credsStore/credHelpers, or the plain config.json
+// file) that `docker login` would write to, so that BuildKit's
+// authprovider.NewDockerAuthProvider can pick them back up without this
+// provider ever needing a `docker` binary on PATH.
+func storeRegistryCredentials(server, username, password string) error {
+	configFile := config.LoadDefaultConfigFile(os.Stderr)
+	err := configFile.GetCredentialsStore(server).Store(types.AuthConfig{
+		Username:      username,
+		Password:      password,
+		ServerAddress: server,
+	})
+	if err != nil {
+		return fmt.Errorf("storing credentials for %s: %w", server, err)
+	}
+	return nil
+}
@@ -0,0 +1,422 @@
+// Copyright 2016-2020, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/exporter/containerimage/exptypes"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/session/auth/authprovider"
+	"github.com/moby/buildkit/session/secrets/secretsprovider"
+	"github.com/moby/buildkit/session/sshforward/sshprovider"
+	"github.com/moby/buildkit/util/progress/progressui"
+	"github.com/pulumi/pulumi/pkg/v3/resource/provider"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diag"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/plugin"
+	"golang.org/x/sync/errgroup"
+)
+
+// defaultBuildkitHost is used when the resource does not set buildkitHost
+// explicitly. It matches the address buildkitd listens on by default when
+// run as a system service alongside the Docker daemon.
+const defaultBuildkitHost = "unix:///run/buildkit/buildkitd.sock"
+
+func (k *dockerBuildkitProvider) dockerBuild(
+	ctx context.Context,
+	urn resource.URN,
+	props *structpb.Struct,
+) (*structpb.Struct, error) {
+	inputs, err := plugin.UnmarshalProperties(props, plugin.MarshalOptions{KeepUnknowns: true, SkipNulls: true})
+	if err != nil {
+		return nil, err
+	}
+	applyDefaults(inputs)
+	name := inputs["name"].StringValue()
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %q: %w", name, err)
+	}
+	buildContext := inputs["context"].StringValue()
+	dockerfile := inputs["dockerfile"].StringValue()
+	target := inputs["target"].StringValue()
+	registry := inputs["registry"].ObjectValue()
+	additionalContexts := stringMap(inputs["additionalContexts"])
+
+	contextDigest, err := hashContext(ctx, buildContext, dockerfile, additionalContexts, k.contextHashConcurrency, k.ctxHashCacheHandle())
+	if err != nil {
+		return nil, err
+	}
+
+	username, password, ok, err := resolveRegistryCredentials(registry)
+	if err != nil {
+		return nil, fmt.Errorf("resolving registry credentials: %w", err)
+	}
+	if ok {
+		// Store the resolved credentials the same way `docker login` does,
+		// but natively in Go rather than shelling out: BuildKit picks them
+		// back up from this same store via authprovider.NewDockerAuthProvider
+		// in buildkitSolve. This keeps the provider usable in environments
+		// with no `docker` binary on PATH, such as a Kubernetes job image.
+		//
+		// On macOS, it seems simultaneous writes to the credential store can
+		// fail. See #6. Use a lock to prevent multiple `dockerBuild` requests
+		// from writing credentials simultaneously.
+		k.loginLock.Lock()
+		err := storeRegistryCredentials(registry["server"].StringValue(), username, password)
+		k.loginLock.Unlock()
+		if err != nil {
+			return nil, fmt.Errorf("storing registry credentials: %w", err)
+		}
+	}
+
+	var platforms []string
+	for _, v := range inputs["platforms"].ArrayValue() {
+		platforms = append(platforms, v.StringValue())
+	}
+
+	buildkitHost := defaultBuildkitHost
+	if host := inputs["buildkitHost"]; !host.IsNull() {
+		buildkitHost = host.StringValue()
+	}
+
+	attachables, cleanupSecrets, err := buildSessionAttachables(inputs)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanupSecrets()
+
+	repoDigest, err := k.buildkitSolve(ctx, urn, buildkitSolveArgs{
+		name:               name,
+		context:            buildContext,
+		dockerfile:         dockerfile,
+		target:             target,
+		platforms:          platforms,
+		buildArgs:          inputs["args"],
+		cacheFrom:          parseCacheOptions(inputs["cacheFrom"]),
+		cacheTo:            parseCacheOptions(inputs["cacheTo"]),
+		additionalContexts: additionalContexts,
+		attachables:        attachables,
+		host:               buildkitHost,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("buildkit solve failed: %w", err)
+	}
+	repoDigest = fmt.Sprintf("%s@%s", reference.Path(named), repoDigest)
+
+	var signatureDigest string
+	if signArgs, ok := parseSignArgs(inputs["sign"]); ok {
+		signatureDigest, err = k.signImage(ctx, urn, registry, repoDigest, signArgs)
+		if err != nil {
+			return nil, fmt.Errorf("signing image: %w", err)
+		}
+	}
+
+	outputs := resource.NewPropertyMapFromMap(map[string]interface{}{
+		"dockerfile":     dockerfile,
+		"context":        buildContext,
+		"target":         target,
+		"name":           name,
+		"platforms":      platforms,
+		"contextDigest":  contextDigest,
+		"repoDigest":     repoDigest,
+		"registryServer": registry["server"].StringValue(),
+		"buildkitHost":   buildkitHost,
+		"skipDelete":     inputs["skipDelete"].BoolValue(),
+	})
+	outputs["cacheFrom"] = inputs["cacheFrom"]
+	outputs["cacheTo"] = inputs["cacheTo"]
+	outputs["additionalContexts"] = inputs["additionalContexts"]
+	outputs["sign"] = inputs["sign"]
+	if signatureDigest != "" {
+		outputs["signatureDigest"] = resource.NewStringProperty(signatureDigest)
+	}
+	return plugin.MarshalProperties(outputs, plugin.MarshalOptions{KeepUnknowns: true, SkipNulls: true})
+}
+
+type buildkitSolveArgs struct {
+	name               string
+	context            string
+	dockerfile         string
+	target             string
+	platforms          []string
+	buildArgs          resource.PropertyValue
+	cacheFrom          []client.CacheOptionsEntry
+	cacheTo            []client.CacheOptionsEntry
+	additionalContexts map[string]string
+	attachables        []session.Attachable
+	host               string
+}
+
+// stringMap converts an object-typed input property into a plain
+// map[string]string, returning nil if the property is unset.
+func stringMap(v resource.PropertyValue) map[string]string {
+	if v.IsNull() {
+		return nil
+	}
+	m := map[string]string{}
+	for key, value := range v.ObjectValue() {
+		m[string(key)] = value.StringValue()
+	}
+	return m
+}
+
+// buildSessionAttachables builds the BuildKit session attachables that expose
+// the resource's secrets and sshSockets inputs to, respectively,
+// `RUN --mount=type=secret,id=...` and `RUN --mount=type=ssh` mounts. The
+// returned cleanup func removes any temporary files created for secrets with
+// a literal value and must be called once the build finishes, successfully
+// or not.
+func buildSessionAttachables(inputs resource.PropertyMap) ([]session.Attachable, func(), error) {
+	var tempFiles []string
+	cleanup := func() {
+		for _, f := range tempFiles {
+			os.Remove(f)
+		}
+	}
+
+	var attachables []session.Attachable
+
+	if secretsInput := inputs["secrets"]; !secretsInput.IsNull() {
+		var sources []secretsprovider.Source
+		for _, v := range secretsInput.ArrayValue() {
+			s := v.ObjectValue()
+			src := secretsprovider.Source{ID: s["id"].StringValue()}
+			switch {
+			case !s["value"].IsNull():
+				f, err := ioutil.TempFile("", "pulumi-docker-buildkit-secret-")
+				if err != nil {
+					cleanup()
+					return nil, func() {}, fmt.Errorf("creating secret tempfile: %w", err)
+				}
+				tempFiles = append(tempFiles, f.Name())
+				err = func() error {
+					defer f.Close()
+					if err := f.Chmod(0600); err != nil {
+						return err
+					}
+					_, err := f.WriteString(s["value"].StringValue())
+					return err
+				}()
+				if err != nil {
+					cleanup()
+					return nil, func() {}, fmt.Errorf("writing secret tempfile: %w", err)
+				}
+				src.FilePath = f.Name()
+			case !s["path"].IsNull():
+				src.FilePath = s["path"].StringValue()
+			case !s["env"].IsNull():
+				src.Env = s["env"].StringValue()
+			}
+			sources = append(sources, src)
+		}
+		store, err := secretsprovider.NewStore(sources)
+		if err != nil {
+			cleanup()
+			return nil, func() {}, fmt.Errorf("configuring secrets: %w", err)
+		}
+		attachables = append(attachables, secretsprovider.NewSecretProvider(store))
+	}
+
+	if sshInput := inputs["sshSockets"]; !sshInput.IsNull() {
+		var confs []sshprovider.AgentConfig
+		for _, v := range sshInput.ArrayValue() {
+			s := v.ObjectValue()
+			conf := sshprovider.AgentConfig{ID: s["id"].StringValue()}
+			if paths := s["paths"]; !paths.IsNull() {
+				for _, p := range paths.ArrayValue() {
+					conf.Paths = append(conf.Paths, p.StringValue())
+				}
+			}
+			confs = append(confs, conf)
+		}
+		agentProvider, err := sshprovider.NewSSHAgentProvider(confs)
+		if err != nil {
+			cleanup()
+			return nil, func() {}, fmt.Errorf("configuring ssh agent forwarding: %w", err)
+		}
+		attachables = append(attachables, agentProvider)
+	}
+
+	return attachables, cleanup, nil
+}
+
+// parseCacheOptions converts a `{ type, params }[]` input property into the
+// BuildKit client's CacheOptionsEntry, matching the `--cache-from`/
+// `--cache-to type=...,key=value` CLI syntax.
+func parseCacheOptions(v resource.PropertyValue) []client.CacheOptionsEntry {
+	if v.IsNull() {
+		return nil
+	}
+	var entries []client.CacheOptionsEntry
+	for _, item := range v.ArrayValue() {
+		obj := item.ObjectValue()
+		attrs := map[string]string{}
+		if params := obj["params"]; !params.IsNull() {
+			for key, value := range params.ObjectValue() {
+				attrs[string(key)] = value.StringValue()
+			}
+		}
+		entries = append(entries, client.CacheOptionsEntry{
+			Type:  obj["type"].StringValue(),
+			Attrs: attrs,
+		})
+	}
+	return entries
+}
+
+// buildkitSolve drives a build+push through a buildkitd instance reachable at
+// args.host, which may be a unix://, tcp://, docker-container://, or
+// kube-pod:// address. It returns the digest of the pushed image manifest.
+func (k *dockerBuildkitProvider) buildkitSolve(
+	ctx context.Context,
+	urn resource.URN,
+	args buildkitSolveArgs,
+) (string, error) {
+	c, err := client.New(ctx, args.host)
+	if err != nil {
+		return "", fmt.Errorf("connecting to buildkitd at %s: %w", args.host, err)
+	}
+	defer c.Close()
+
+	contextDir, err := filepath.Abs(args.context)
+	if err != nil {
+		return "", fmt.Errorf("resolving context path: %w", err)
+	}
+	dockerfileDir, err := filepath.Abs(filepath.Join(args.context, filepath.Dir(args.dockerfile)))
+	if err != nil {
+		return "", fmt.Errorf("resolving dockerfile path: %w", err)
+	}
+
+	frontendAttrs := map[string]string{
+		"filename": filepath.Base(args.dockerfile),
+	}
+	if args.target != "" {
+		frontendAttrs["target"] = args.target
+	}
+	if len(args.platforms) > 0 {
+		frontendAttrs["platform"] = strings.Join(args.platforms, ",")
+	}
+	if !args.buildArgs.IsNull() {
+		for _, v := range args.buildArgs.ArrayValue() {
+			key := v.ObjectValue()["key"].StringValue()
+			value := v.ObjectValue()["value"].StringValue()
+			frontendAttrs["build-arg:"+key] = value
+		}
+	}
+
+	localDirs := map[string]string{
+		"context":    contextDir,
+		"dockerfile": dockerfileDir,
+	}
+	for name, value := range args.additionalContexts {
+		switch {
+		case isOCIImageContext(value), isRemoteContext(value):
+			frontendAttrs["context:"+name] = value
+		default:
+			abs, err := filepath.Abs(value)
+			if err != nil {
+				return "", fmt.Errorf("resolving additional context %q: %w", name, err)
+			}
+			localDirs[name] = abs
+			frontendAttrs["context:"+name] = "local:" + name
+		}
+	}
+
+	solveOpt := client.SolveOpt{
+		Frontend:      "dockerfile.v0",
+		FrontendAttrs: frontendAttrs,
+		LocalDirs:     localDirs,
+		Exports: []client.ExportEntry{
+			{
+				Type: client.ExporterImage,
+				Attrs: map[string]string{
+					"name": args.name,
+					"push": "true",
+				},
+			},
+		},
+		Session: append([]session.Attachable{
+			authprovider.NewDockerAuthProvider(os.Stderr),
+		}, args.attachables...),
+		CacheImports: args.cacheFrom,
+		CacheExports: args.cacheTo,
+	}
+
+	statusCh := make(chan *client.SolveStatus)
+	logW := &logWriter{ctx: ctx, host: k.host, urn: urn, severity: diag.Info}
+
+	eg, egCtx := errgroup.WithContext(ctx)
+	var resp *client.SolveResponse
+	eg.Go(func() error {
+		var solveErr error
+		resp, solveErr = c.Solve(egCtx, nil, solveOpt, statusCh)
+		return solveErr
+	})
+	eg.Go(func() error {
+		return progressui.DisplaySolveStatus(egCtx, "", nil, logW, statusCh)
+	})
+	if err := eg.Wait(); err != nil {
+		return "", err
+	}
+
+	digest, ok := resp.ExporterResponse[exptypes.ExporterImageDigestKey]
+	if !ok {
+		return "", fmt.Errorf("solve response did not include an image digest")
+	}
+	return digest, nil
+}
+
+func runCommand(
+	ctx context.Context,
+	host *provider.HostClient,
+	urn resource.URN,
+	cmd *exec.Cmd,
+) error {
+	cmd.Stdout = &logWriter{
+		ctx:      ctx,
+		host:     host,
+		urn:      urn,
+		severity: diag.Info,
+	}
+	cmd.Stderr = &logWriter{
+		ctx:      ctx,
+		host:     host,
+		urn:      urn,
+		severity: diag.Info,
+	}
+	return cmd.Run()
+}
+
+type logWriter struct {
+	ctx      context.Context
+	host     *provider.HostClient
+	urn      resource.URN
+	severity diag.Severity
+}
+
+func (w *logWriter) Write(p []byte) (n int, err error) {
+	return len(p), w.host.Log(w.ctx, w.severity, w.urn, string(p))
+}
@@ -0,0 +1,83 @@
+// Copyright 2016-2020, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/docker/distribution/reference"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diag"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+)
+
+// deleteFromRegistry issues a registry v2 manifest delete for the digest
+// stored in props's repoDigest, so that `pulumi destroy` actually reclaims
+// registry storage. Registries that decline to delete manifests (as Docker
+// Hub does) are logged as a warning and otherwise ignored, since there is
+// nothing more this provider can do.
+func (k *dockerBuildkitProvider) deleteFromRegistry(ctx context.Context, urn resource.URN, props resource.PropertyMap) error {
+	repoDigest := props["repoDigest"].StringValue()
+	named, dgst, err := parseRepoDigest(repoDigest)
+	if err != nil {
+		return fmt.Errorf("parsing repoDigest %q: %w", repoDigest, err)
+	}
+
+	registry := resource.PropertyMap{
+		"server": resource.NewStringProperty(props["registryServer"].StringValue()),
+	}
+	username, password, _, err := resolveRegistryCredentials(registry)
+	if err != nil {
+		return fmt.Errorf("resolving registry credentials: %w", err)
+	}
+
+	repoClient, err := newRegistryClient(
+		ctx,
+		registry["server"].StringValue(),
+		reference.Path(named),
+		username,
+		password,
+	)
+	if err != nil {
+		return fmt.Errorf("connecting to registry: %w", err)
+	}
+
+	if err := repoClient.deleteManifest(ctx, dgst); err != nil {
+		if errors.Is(err, errDeleteUnsupported) {
+			k.host.Log(ctx, diag.Warning, urn, fmt.Sprintf(
+				"registry does not support deleting manifests; leaving %s in place", repoDigest,
+			))
+			return nil
+		}
+		return fmt.Errorf("deleting manifest %s: %w", repoDigest, err)
+	}
+	return nil
+}
+
+// parseRepoDigest splits a repoDigest of the form name@sha256:... into its
+// repository and digest.
+func parseRepoDigest(repoDigest string) (reference.Named, digest.Digest, error) {
+	named, err := reference.ParseNormalizedNamed(repoDigest)
+	if err != nil {
+		return nil, "", err
+	}
+	canonical, ok := named.(reference.Canonical)
+	if !ok {
+		return nil, "", fmt.Errorf("%q is not a digest reference", repoDigest)
+	}
+	return named, canonical.Digest(), nil
+}
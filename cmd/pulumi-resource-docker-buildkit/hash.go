@@ -0,0 +1,490 @@
+// Copyright 2016-2020, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/pkg/fileutils"
+	"github.com/moby/buildkit/frontend/dockerfile/dockerignore"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	bolt "go.etcd.io/bbolt"
+)
+
+type contextHash struct {
+	contextPath string
+	input       bytes.Buffer
+}
+
+func newContextHash(contextPath string) *contextHash {
+	return &contextHash{contextPath: contextPath}
+}
+
+func (ch *contextHash) hashPath(path string, fileMode fs.FileMode) error {
+	f, err := os.Open(filepath.Join(ch.contextPath, path))
+	if err != nil {
+		return fmt.Errorf("open %s: %w", path, err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return fmt.Errorf("read %s: %w", path, err)
+	}
+	ch.input.Write([]byte(path))
+	ch.input.Write([]byte(fileMode.String()))
+	ch.input.Write(h.Sum(nil))
+	ch.input.WriteByte(0)
+	return nil
+}
+
+// pathEntry is a single file discovered under the build context, queued up
+// for hashing by the worker pool in hashPathsConcurrently. index is its
+// position in the original sequential filepath.WalkDir order, which
+// hashPathsConcurrently restores the results to.
+type pathEntry struct {
+	index int
+	path  string
+	mode  fs.FileMode
+}
+
+// hashedEntry is the result of hashing a pathEntry, carrying its index so
+// hashPathsConcurrently can place it back at the same position the
+// sequential walk visited it, regardless of which worker finishes first.
+type hashedEntry struct {
+	index int
+	path  string
+	mode  fs.FileMode
+	sum   []byte
+}
+
+// ctxHashCacheBucket is the bolt bucket holding cached file digests.
+const ctxHashCacheBucket = "ctxhash"
+
+// defaultContextHashConcurrency is used when no contextHashConcurrency
+// provider config is set.
+func defaultContextHashConcurrency() int {
+	if n := runtime.NumCPU(); n > 0 {
+		return n
+	}
+	return 1
+}
+
+// ctxHashCacheDir returns the directory holding the on-disk context hash
+// cache, honoring XDG_CACHE_HOME like other XDG-aware tooling.
+func ctxHashCacheDir() string {
+	if dir := os.Getenv("XDG_CACHE_HOME"); dir != "" {
+		return filepath.Join(dir, "pulumi-docker-buildkit")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "pulumi-docker-buildkit")
+	}
+	return filepath.Join(home, ".cache", "pulumi-docker-buildkit")
+}
+
+// openCtxHashCache opens (creating if necessary) the bolt database caching
+// file digests keyed by (abspath, size, mtime_ns). A nil db with a nil error
+// is never returned; callers that can't afford the cache should treat a
+// non-nil error as "proceed without caching" rather than failing the build.
+func openCtxHashCache() (*bolt.DB, error) {
+	dir := ctxHashCacheDir()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating context hash cache dir: %w", err)
+	}
+	db, err := bolt.Open(filepath.Join(dir, "ctxhash.bolt"), 0o644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening context hash cache: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(ctxHashCacheBucket))
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("initializing context hash cache: %w", err)
+	}
+	return db, nil
+}
+
+// ctxHashCacheKey identifies a cache entry by the stat tuple that, if
+// unchanged, means the file's contents haven't changed either.
+func ctxHashCacheKey(absPath string, size, modTimeNs int64) []byte {
+	return []byte(fmt.Sprintf("%s\x00%d\x00%d", absPath, size, modTimeNs))
+}
+
+func ctxHashCacheGet(db *bolt.DB, key []byte) []byte {
+	if db == nil {
+		return nil
+	}
+	var sum []byte
+	_ = db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte(ctxHashCacheBucket)).Get(key); v != nil {
+			sum = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	return sum
+}
+
+func ctxHashCachePut(db *bolt.DB, key, sum []byte) {
+	if db == nil {
+		return
+	}
+	_ = db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(ctxHashCacheBucket)).Put(key, sum)
+	})
+}
+
+// hashFileCached sums a single file, reusing a cached digest when the
+// file's (size, mtime) stat tuple hasn't changed since it was last hashed.
+func (ch *contextHash) hashFileCached(cache *bolt.DB, path string) ([]byte, error) {
+	full := filepath.Join(ch.contextPath, path)
+	info, err := os.Stat(full)
+	if err != nil {
+		return nil, fmt.Errorf("stat %s: %w", path, err)
+	}
+	key := ctxHashCacheKey(full, info.Size(), info.ModTime().UnixNano())
+	if sum := ctxHashCacheGet(cache, key); sum != nil {
+		return sum, nil
+	}
+	f, err := os.Open(full)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	sum := h.Sum(nil)
+	ctxHashCachePut(cache, key, sum)
+	return sum, nil
+}
+
+// hashPathsConcurrently hashes every entry with a bounded pool of workers,
+// then merges the results back into entries' original sequential-walk order
+// before folding them into the digest, so the final contextDigest.input
+// framing (and thus the resulting hash) is identical to hashing the same
+// tree serially. Restoring by index rather than sorting by path matters:
+// filepath.WalkDir visits "data/x.txt" before "data.json" (it descends into
+// the directory before continuing the listing), but '.' < '/' so a path
+// sort would reorder them relative to the serial walk.
+func (ch *contextHash) hashPathsConcurrently(ctx context.Context, entries []pathEntry, concurrency int, cache *bolt.DB) error {
+	if concurrency <= 0 {
+		concurrency = defaultContextHashConcurrency()
+	}
+	if len(entries) < concurrency {
+		concurrency = len(entries)
+	}
+	if concurrency == 0 {
+		return nil
+	}
+
+	// workCtx is cancelled once this call returns (including on error),
+	// so a producer or worker blocked on a send never outlives the call.
+	workCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan pathEntry)
+	results := make(chan hashedEntry)
+	errs := make(chan error, concurrency)
+
+	var workers sync.WaitGroup
+	workers.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer workers.Done()
+			for entry := range jobs {
+				sum, err := ch.hashFileCached(cache, entry.path)
+				if err != nil {
+					errs <- fmt.Errorf("hashing %q: %w", entry.path, err)
+					// Stop feeding and draining queued/in-flight work now
+					// rather than waiting for every other file to hash.
+					cancel()
+					return
+				}
+				select {
+				case results <- hashedEntry{index: entry.index, path: entry.path, mode: entry.mode, sum: sum}:
+				case <-workCtx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		workers.Wait()
+		close(results)
+		close(errs)
+	}()
+	go func() {
+		defer close(jobs)
+		for _, entry := range entries {
+			select {
+			case jobs <- entry:
+			case <-workCtx.Done():
+				return
+			}
+		}
+	}()
+
+	merged := make([]hashedEntry, len(entries))
+	for result := range results {
+		merged[result.index] = result
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case err := <-errs:
+		if err != nil {
+			return err
+		}
+	default:
+	}
+
+	for _, entry := range merged {
+		ch.input.Write([]byte(entry.path))
+		ch.input.Write([]byte(entry.mode.String()))
+		ch.input.Write(entry.sum)
+		ch.input.WriteByte(0)
+	}
+	return nil
+}
+
+func (ch *contextHash) hexSum() string {
+	h := sha256.New()
+	ch.input.WriteTo(h)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// hashString folds an arbitrary key/value pair into the hash, for additional
+// contexts that contribute something other than a local file tree.
+func (ch *contextHash) hashString(key, value string) {
+	ch.input.WriteString(key)
+	ch.input.WriteByte(0)
+	ch.input.WriteString(value)
+	ch.input.WriteByte(0)
+}
+
+// hashDir folds every file under dir into the hash, keyed by name so that
+// the same relative path under two different additional contexts doesn't
+// collide. Unlike the primary build context, .dockerignore isn't consulted,
+// since additional contexts aren't Dockerfile build contexts in their own
+// right.
+func (ch *contextHash) hashDir(name, dir string) error {
+	return filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return fmt.Errorf("determining mode for %q: %w", path, err)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("open %s: %w", path, err)
+		}
+		defer f.Close()
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return fmt.Errorf("read %s: %w", path, err)
+		}
+		ch.input.WriteString(name)
+		ch.input.WriteByte(0)
+		ch.input.Write([]byte(rel))
+		ch.input.Write([]byte(info.Mode().String()))
+		ch.input.Write(h.Sum(nil))
+		ch.input.WriteByte(0)
+		return nil
+	})
+}
+
+// isOCIImageContext reports whether an additional build context value refers
+// to an OCI/Docker image, as opposed to a local path or a git/HTTP URL.
+func isOCIImageContext(value string) bool {
+	return strings.HasPrefix(value, "docker-image://")
+}
+
+// isRemoteContext reports whether an additional build context value is a
+// remote reference (git, HTTP, or OCI image) rather than a local path.
+func isRemoteContext(value string) bool {
+	return strings.Contains(value, "://") || strings.HasPrefix(value, "git@")
+}
+
+// resolveOCIImageContextDigest resolves the digest of the image referenced
+// by an OCI additional build context, via a registry HEAD request if the
+// reference isn't already pinned to a digest.
+func resolveOCIImageContextDigest(ctx context.Context, value string) (string, error) {
+	ref := strings.TrimPrefix(value, "docker-image://")
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return "", fmt.Errorf("parsing %q: %w", ref, err)
+	}
+	if canonical, ok := named.(reference.Canonical); ok {
+		return canonical.Digest().String(), nil
+	}
+	tagged, ok := reference.TagNameOnly(named).(reference.NamedTagged)
+	if !ok {
+		return "", fmt.Errorf("%q is not a tagged or digested reference", ref)
+	}
+
+	domain := reference.Domain(named)
+	username, password, _, err := resolveRegistryCredentials(resource.PropertyMap{
+		"server": resource.NewStringProperty(domain),
+	})
+	if err != nil {
+		return "", fmt.Errorf("resolving registry credentials: %w", err)
+	}
+	repoClient, err := newRegistryClient(ctx, domain, reference.Path(named), username, password)
+	if err != nil {
+		return "", fmt.Errorf("connecting to registry: %w", err)
+	}
+	desc, err := repoClient.headManifestTag(ctx, tagged.Tag())
+	if err != nil {
+		return "", fmt.Errorf("fetching manifest: %w", err)
+	}
+	return desc.Digest.String(), nil
+}
+
+// hashContext digests the build context for change detection. concurrency
+// bounds the worker pool used to hash context files in parallel; zero or
+// negative selects defaultContextHashConcurrency(). cache is the long-lived
+// context hash cache handle (see dockerBuildkitProvider.ctxHashCacheHandle);
+// a nil cache means proceed without caching rather than fail the build.
+func hashContext(
+	ctx context.Context,
+	contextPath string,
+	dockerfile string,
+	additionalContexts map[string]string,
+	concurrency int,
+	cache *bolt.DB,
+) (string, error) {
+	dockerIgnorePath := dockerfile + ".dockerignore"
+	dockerIgnore, err := os.ReadFile(dockerIgnorePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			dockerIgnorePath = filepath.Join(contextPath, ".dockerignore")
+			dockerIgnore, err = os.ReadFile(dockerIgnorePath)
+			if err != nil && !os.IsNotExist(err) {
+				return "", fmt.Errorf("unable to read %s file: %w", dockerIgnorePath, err)
+			}
+		} else {
+			return "", fmt.Errorf("unable to read %s file: %w", dockerIgnorePath, err)
+		}
+	}
+	ignorePatterns, err := dockerignore.ReadAll(bytes.NewReader(dockerIgnore))
+	if err != nil {
+		return "", fmt.Errorf("unable to parse %s file: %w", dockerIgnorePath, err)
+	}
+	ignoreMatcher, err := fileutils.NewPatternMatcher(ignorePatterns)
+	if err != nil {
+		return "", fmt.Errorf("unable to load rules from %s: %w", dockerIgnorePath, err)
+	}
+	ch := newContextHash(contextPath)
+	err = ch.hashPath(dockerfile, 0)
+	if err != nil {
+		return "", fmt.Errorf("hashing dockerfile %q: %w", dockerfile, err)
+	}
+
+	// Walking the tree itself stays sequential, since filepath.WalkDir's
+	// SkipDir pruning depends on visiting parents before children. Only the
+	// (comparatively expensive) per-file hashing is farmed out to workers.
+	var entries []pathEntry
+	err = filepath.WalkDir(contextPath, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		path, err = filepath.Rel(contextPath, path)
+		if err != nil {
+			return err
+		}
+		if path == "." {
+			return nil
+		}
+		ignore, err := ignoreMatcher.Matches(path)
+		if err != nil {
+			return fmt.Errorf("%s rule failed: %w", dockerIgnorePath, err)
+		}
+		if ignore {
+			if d.IsDir() {
+				return filepath.SkipDir
+			} else {
+				return nil
+			}
+		} else if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return fmt.Errorf("determining mode for %q: %w", path, err)
+		}
+		entries = append(entries, pathEntry{index: len(entries), path: path, mode: info.Mode()})
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to hash build context: %w", err)
+	}
+
+	if err := ch.hashPathsConcurrently(ctx, entries, concurrency, cache); err != nil {
+		return "", fmt.Errorf("unable to hash build context: %w", err)
+	}
+
+	names := make([]string, 0, len(additionalContexts))
+	for name := range additionalContexts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := additionalContexts[name]
+		switch {
+		case isOCIImageContext(value):
+			digest, err := resolveOCIImageContextDigest(ctx, value)
+			if err != nil {
+				return "", fmt.Errorf("resolving additional context %q: %w", name, err)
+			}
+			ch.hashString("context:"+name, digest)
+		case isRemoteContext(value):
+			ch.hashString("context:"+name, value)
+		default:
+			if err := ch.hashDir(name, value); err != nil {
+				return "", fmt.Errorf("hashing additional context %q: %w", name, err)
+			}
+		}
+	}
+
+	return ch.hexSum(), nil
+}
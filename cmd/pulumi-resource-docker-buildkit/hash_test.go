@@ -0,0 +1,206 @@
+// Copyright 2016-2020, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// writeTestContext lays out a small build context with a Dockerfile and a
+// handful of files at varying depths, so the walk exercises both the root
+// and a subdirectory.
+func writeTestContext(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	files := map[string]string{
+		"Dockerfile":     "FROM scratch\n",
+		"a.txt":          "a",
+		"b.txt":          "b",
+		"sub/c.txt":      "c",
+		"sub/d.txt":      "d",
+		"sub/deep/e.txt": "e",
+	}
+	for rel, contents := range files {
+		full := filepath.Join(dir, rel)
+		if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+			t.Fatalf("mkdir %s: %v", rel, err)
+		}
+		if err := os.WriteFile(full, []byte(contents), 0o644); err != nil {
+			t.Fatalf("write %s: %v", rel, err)
+		}
+	}
+	return dir
+}
+
+// openTestCache opens a context hash cache backed by a fresh temp dir, for
+// tests that need to exercise caching explicitly via a shared handle (rather
+// than the no-caching nil hashContext now accepts).
+func openTestCache(t *testing.T) *bolt.DB {
+	t.Helper()
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	db, err := openCtxHashCache()
+	if err != nil {
+		t.Fatalf("openCtxHashCache: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// TestHashContextConcurrencyIsDeterministic checks that hashContext produces
+// the same digest regardless of how many workers hash the tree, so that
+// hashPathsConcurrently's merge-sort keeps the result order-independent.
+func TestHashContextConcurrencyIsDeterministic(t *testing.T) {
+	dir := writeTestContext(t)
+	cache := openTestCache(t)
+
+	concurrencies := []int{1, 2, 4, 8}
+	var want string
+	for i, concurrency := range concurrencies {
+		got, err := hashContext(context.Background(), dir, "Dockerfile", nil, concurrency, cache)
+		if err != nil {
+			t.Fatalf("hashContext(concurrency=%d): %v", concurrency, err)
+		}
+		if i == 0 {
+			want = got
+			continue
+		}
+		if got != want {
+			t.Errorf("hashContext(concurrency=%d) = %s, want %s (concurrency=%d)",
+				concurrency, got, want, concurrencies[0])
+		}
+	}
+}
+
+// TestHashContextCacheHitMatchesUncached checks that a cached digest (where
+// every file's stat tuple is unchanged) matches the digest computed with a
+// cold cache.
+func TestHashContextCacheHitMatchesUncached(t *testing.T) {
+	dir := writeTestContext(t)
+	cache := openTestCache(t)
+
+	cold, err := hashContext(context.Background(), dir, "Dockerfile", nil, 1, cache)
+	if err != nil {
+		t.Fatalf("hashContext (cold cache): %v", err)
+	}
+	warm, err := hashContext(context.Background(), dir, "Dockerfile", nil, 1, cache)
+	if err != nil {
+		t.Fatalf("hashContext (warm cache): %v", err)
+	}
+	if warm != cold {
+		t.Errorf("hashContext with a warm cache = %s, want %s (same as cold cache)", warm, cold)
+	}
+}
+
+// serialHashContext reproduces the pre-concurrency algorithm's digest: a
+// single filepath.WalkDir pass hashing each file as it's visited, with no
+// worker pool and no cache. It's used as the ground truth that the
+// concurrent implementation must still match.
+func serialHashContext(t *testing.T, dir string) string {
+	t.Helper()
+	ch := newContextHash(dir)
+	if err := ch.hashPath("Dockerfile", 0); err != nil {
+		t.Fatalf("hashPath(Dockerfile): %v", err)
+	}
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		path, err = filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if path == "." || d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return ch.hashPath(path, info.Mode())
+	})
+	if err != nil {
+		t.Fatalf("walking %s: %v", dir, err)
+	}
+	return ch.hexSum()
+}
+
+// TestHashContextMatchesSerialTraversalOrder checks that the concurrent
+// worker pool restores results to the same order filepath.WalkDir visited
+// them in, not lexicographic path order. A directory whose name is a
+// file-name prefix at the same level, e.g. "data/" next to "data.json", is
+// the case where the two orders diverge: WalkDir visits "data/x.txt" before
+// "data.json" (it descends into the directory before continuing the
+// listing), but '.' (0x2E) sorts before '/' (0x2F), so a plain string sort
+// of paths would produce "data.json" before "data/x.txt" instead.
+func TestHashContextMatchesSerialTraversalOrder(t *testing.T) {
+	dir := t.TempDir()
+	cache := openTestCache(t)
+
+	mustWrite := func(rel, contents string) {
+		full := filepath.Join(dir, rel)
+		if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+			t.Fatalf("mkdir %s: %v", rel, err)
+		}
+		if err := os.WriteFile(full, []byte(contents), 0o644); err != nil {
+			t.Fatalf("write %s: %v", rel, err)
+		}
+	}
+	mustWrite("Dockerfile", "FROM scratch\n")
+	mustWrite("data.json", "{}")
+	mustWrite("data/x.txt", "x")
+
+	want := serialHashContext(t, dir)
+
+	for _, concurrency := range []int{1, 2, 4} {
+		got, err := hashContext(context.Background(), dir, "Dockerfile", nil, concurrency, cache)
+		if err != nil {
+			t.Fatalf("hashContext(concurrency=%d): %v", concurrency, err)
+		}
+		if got != want {
+			t.Errorf("hashContext(concurrency=%d) = %s, want %s (serial traversal order)", concurrency, got, want)
+		}
+	}
+}
+
+// TestHashContextChangedFileChangesDigest checks that editing a file's
+// contents (and thus its mtime) invalidates the cache and changes the
+// resulting digest.
+func TestHashContextChangedFileChangesDigest(t *testing.T) {
+	dir := writeTestContext(t)
+	cache := openTestCache(t)
+
+	before, err := hashContext(context.Background(), dir, "Dockerfile", nil, 4, cache)
+	if err != nil {
+		t.Fatalf("hashContext (before edit): %v", err)
+	}
+
+	target := filepath.Join(dir, "sub", "c.txt")
+	if err := os.WriteFile(target, []byte("changed"), 0o644); err != nil {
+		t.Fatalf("editing %s: %v", target, err)
+	}
+
+	after, err := hashContext(context.Background(), dir, "Dockerfile", nil, 4, cache)
+	if err != nil {
+		t.Fatalf("hashContext (after edit): %v", err)
+	}
+	if after == before {
+		t.Errorf("hashContext digest unchanged after editing %s", target)
+	}
+}
@@ -15,34 +15,33 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
 	"fmt"
-	"io"
-	"io/fs"
-	"os"
-	"os/exec"
-	"path/filepath"
-	"strings"
+	"strconv"
 	"sync"
 
-	"github.com/docker/docker/pkg/fileutils"
 	pbempty "github.com/golang/protobuf/ptypes/empty"
 	structpb "github.com/golang/protobuf/ptypes/struct"
-	"github.com/moby/buildkit/frontend/dockerfile/dockerignore"
 	"github.com/pulumi/pulumi/pkg/v3/resource/provider"
-	"github.com/pulumi/pulumi/sdk/v3/go/common/diag"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/plugin"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/cmdutil"
 	rpc "github.com/pulumi/pulumi/sdk/v3/proto/go"
+	bolt "go.etcd.io/bbolt"
 )
 
 // Injected by linker in release builds.
 var version string
 
+const (
+	imageTypeToken        = "docker-buildkit:index:Image"
+	manifestListTypeToken = "docker-buildkit:index:ManifestList"
+
+	// contextHashConcurrencyConfigKey lets users on slow NFS mounts dial
+	// down the build-context hashing worker pool; see hashContext.
+	contextHashConcurrencyConfigKey = "docker-buildkit:contextHashConcurrency"
+)
+
 func main() {
 	err := provider.Main("docker-buildkit", func(host *provider.HostClient) (rpc.ResourceProviderServer, error) {
 		return &dockerBuildkitProvider{
@@ -57,6 +56,35 @@ func main() {
 type dockerBuildkitProvider struct {
 	host      *provider.HostClient
 	loginLock sync.Mutex
+
+	// contextHashConcurrency bounds the worker pool hashContext uses to hash
+	// build context files in parallel. Zero means "use runtime.NumCPU()".
+	contextHashConcurrency int
+
+	// ctxHashCache and ctxHashCacheOnce back ctxHashCacheHandle: the on-disk
+	// context hash cache is opened at most once per provider process and
+	// reused by every hashContext call, rather than opened and closed per
+	// call. bolt.Open takes an exclusive OS file lock for the life of the
+	// handle, so a per-call handle would serialize the concurrent builds
+	// hashContext's worker pool exists to speed up.
+	ctxHashCache     *bolt.DB
+	ctxHashCacheOnce sync.Once
+}
+
+// ctxHashCacheHandle lazily opens the on-disk context hash cache the first
+// time it's needed and returns the same handle on every subsequent call for
+// the life of the provider process. A nil return means the cache couldn't be
+// opened; callers treat that as "proceed without caching" rather than
+// failing the build, same as openCtxHashCache's own contract.
+func (k *dockerBuildkitProvider) ctxHashCacheHandle() *bolt.DB {
+	k.ctxHashCacheOnce.Do(func() {
+		db, err := openCtxHashCache()
+		if err != nil {
+			return
+		}
+		k.ctxHashCache = db
+	})
+	return k.ctxHashCache
 }
 
 func (k *dockerBuildkitProvider) Call(ctx context.Context, req *rpc.CallRequest) (*rpc.CallResponse, error) {
@@ -72,6 +100,13 @@ func (k *dockerBuildkitProvider) DiffConfig(ctx context.Context, req *rpc.DiffRe
 }
 
 func (k *dockerBuildkitProvider) Configure(ctx context.Context, req *rpc.ConfigureRequest) (*rpc.ConfigureResponse, error) {
+	if v, ok := req.GetVariables()[contextHashConcurrencyConfigKey]; ok && v != "" {
+		concurrency, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s %q: %w", contextHashConcurrencyConfigKey, v, err)
+		}
+		k.contextHashConcurrency = concurrency
+	}
 	return &rpc.ConfigureResponse{}, nil
 }
 
@@ -88,7 +123,7 @@ func (k *dockerBuildkitProvider) StreamInvoke(req *rpc.InvokeRequest, server rpc
 func (k *dockerBuildkitProvider) Check(ctx context.Context, req *rpc.CheckRequest) (*rpc.CheckResponse, error) {
 	urn := resource.URN(req.GetUrn())
 	ty := urn.Type()
-	if ty != "docker-buildkit:index:Image" {
+	if ty != imageTypeToken && ty != manifestListTypeToken {
 		return nil, fmt.Errorf("Unknown resource type '%s'", ty)
 	}
 	return &rpc.CheckResponse{Inputs: req.News, Failures: nil}, nil
@@ -97,9 +132,6 @@ func (k *dockerBuildkitProvider) Check(ctx context.Context, req *rpc.CheckReques
 func (k *dockerBuildkitProvider) Diff(ctx context.Context, req *rpc.DiffRequest) (*rpc.DiffResponse, error) {
 	urn := resource.URN(req.GetUrn())
 	ty := urn.Type()
-	if ty != "docker-buildkit:index:Image" {
-		return nil, fmt.Errorf("Unknown resource type '%s'", ty)
-	}
 
 	olds, err := plugin.UnmarshalProperties(req.GetOlds(), plugin.MarshalOptions{KeepUnknowns: true, SkipNulls: true})
 	if err != nil {
@@ -111,17 +143,30 @@ func (k *dockerBuildkitProvider) Diff(ctx context.Context, req *rpc.DiffRequest)
 	if err != nil {
 		return nil, err
 	}
-	applyDefaults(news)
-	news["registryServer"] = news["registry"].ObjectValue()["server"]
-	delete(news, "registry")
-	contextDigest, err := hashContext(
-		news["context"].StringValue(),
-		news["dockerfile"].StringValue(),
-	)
-	if err != nil {
-		return nil, err
+
+	switch ty {
+	case imageTypeToken:
+		applyDefaults(news)
+		news["registryServer"] = news["registry"].ObjectValue()["server"]
+		delete(news, "registry")
+		contextDigest, err := hashContext(
+			ctx,
+			news["context"].StringValue(),
+			news["dockerfile"].StringValue(),
+			stringMap(news["additionalContexts"]),
+			k.contextHashConcurrency,
+			k.ctxHashCacheHandle(),
+		)
+		if err != nil {
+			return nil, err
+		}
+		news["contextDigest"] = resource.NewStringProperty(contextDigest)
+	case manifestListTypeToken:
+		news["registryServer"] = news["registry"].ObjectValue()["server"]
+		delete(news, "registry")
+	default:
+		return nil, fmt.Errorf("Unknown resource type '%s'", ty)
 	}
-	news["contextDigest"] = resource.NewStringProperty(contextDigest)
 
 	d := olds.Diff(news)
 	if d == nil {
@@ -149,11 +194,7 @@ func (k *dockerBuildkitProvider) Diff(ctx context.Context, req *rpc.DiffRequest)
 
 func (k *dockerBuildkitProvider) Create(ctx context.Context, req *rpc.CreateRequest) (*rpc.CreateResponse, error) {
 	urn := resource.URN(req.GetUrn())
-	ty := urn.Type()
-	if ty != "docker-buildkit:index:Image" {
-		return nil, fmt.Errorf("Unknown resource type '%s'", ty)
-	}
-	outputProperties, err := k.dockerBuild(ctx, urn, req.GetProperties())
+	outputProperties, err := k.createOrUpdate(ctx, urn, req.GetProperties())
 	if err != nil {
 		return nil, err
 	}
@@ -166,7 +207,7 @@ func (k *dockerBuildkitProvider) Create(ctx context.Context, req *rpc.CreateRequ
 func (k *dockerBuildkitProvider) Read(ctx context.Context, req *rpc.ReadRequest) (*rpc.ReadResponse, error) {
 	urn := resource.URN(req.GetUrn())
 	ty := urn.Type()
-	if ty != "docker-buildkit:index:Image" {
+	if ty != imageTypeToken && ty != manifestListTypeToken {
 		return nil, fmt.Errorf("Unknown resource type '%s'", ty)
 	}
 	return &rpc.ReadResponse{
@@ -177,11 +218,7 @@ func (k *dockerBuildkitProvider) Read(ctx context.Context, req *rpc.ReadRequest)
 
 func (k *dockerBuildkitProvider) Update(ctx context.Context, req *rpc.UpdateRequest) (*rpc.UpdateResponse, error) {
 	urn := resource.URN(req.GetUrn())
-	ty := urn.Type()
-	if ty != "docker-buildkit:index:Image" {
-		return nil, fmt.Errorf("Unknown resource type '%s'", ty)
-	}
-	outputProperties, err := k.dockerBuild(ctx, urn, req.GetNews())
+	outputProperties, err := k.createOrUpdate(ctx, urn, req.GetNews())
 	if err != nil {
 		return nil, err
 	}
@@ -190,13 +227,39 @@ func (k *dockerBuildkitProvider) Update(ctx context.Context, req *rpc.UpdateRequ
 	}, nil
 }
 
+func (k *dockerBuildkitProvider) createOrUpdate(
+	ctx context.Context,
+	urn resource.URN,
+	props *structpb.Struct,
+) (*structpb.Struct, error) {
+	switch urn.Type() {
+	case imageTypeToken:
+		return k.dockerBuild(ctx, urn, props)
+	case manifestListTypeToken:
+		return k.manifestListPublish(ctx, urn, props)
+	default:
+		return nil, fmt.Errorf("Unknown resource type '%s'", urn.Type())
+	}
+}
+
 func (k *dockerBuildkitProvider) Delete(ctx context.Context, req *rpc.DeleteRequest) (*pbempty.Empty, error) {
 	urn := resource.URN(req.GetUrn())
 	ty := urn.Type()
-	if ty != "docker-buildkit:index:Image" {
+	if ty != imageTypeToken && ty != manifestListTypeToken {
 		return nil, fmt.Errorf("Unknown resource type '%s'", ty)
 	}
-	// Not possible to delete Docker images via the registry API.
+
+	props, err := plugin.UnmarshalProperties(req.GetProperties(), plugin.MarshalOptions{KeepUnknowns: true, SkipNulls: true})
+	if err != nil {
+		return nil, err
+	}
+	if skip := props["skipDelete"]; !skip.IsNull() && skip.BoolValue() {
+		return &pbempty.Empty{}, nil
+	}
+
+	if err := k.deleteFromRegistry(ctx, urn, props); err != nil {
+		return nil, err
+	}
 	return &pbempty.Empty{}, nil
 }
 
@@ -218,248 +281,16 @@ func (k *dockerBuildkitProvider) Cancel(context.Context, *pbempty.Empty) (*pbemp
 	return &pbempty.Empty{}, nil
 }
 
-func (k *dockerBuildkitProvider) dockerBuild(
-	ctx context.Context,
-	urn resource.URN,
-	props *structpb.Struct,
-) (*structpb.Struct, error) {
-	inputs, err := plugin.UnmarshalProperties(props, plugin.MarshalOptions{KeepUnknowns: true, SkipNulls: true})
-	if err != nil {
-		return nil, err
-	}
-	applyDefaults(inputs)
-	name := inputs["name"].StringValue()
-	baseName := strings.Split(name, ":")[0]
-	context := inputs["context"].StringValue()
-	dockerfile := inputs["dockerfile"].StringValue()
-	target := inputs["target"].StringValue()
-	registry := inputs["registry"].ObjectValue()
-	username := registry["username"]
-	password := registry["password"]
-
-	contextDigest, err := hashContext(context, dockerfile)
-	if err != nil {
-		return nil, err
-	}
-
-	if !username.IsNull() && !password.IsNull() {
-		cmd := exec.Command(
-			"docker", "login",
-			"-u", username.StringValue(), "--password-stdin",
-			registry["server"].StringValue(),
-		)
-		cmd.Stdin = strings.NewReader(password.StringValue())
-		// On macOS, it seems simultaneous invocations of `docker login` can
-		// fail. See #6. Use a lock to prevent multiple `dockerBuild` requests
-		// from calling `docker login` simultaneously.
-		k.loginLock.Lock()
-		err := runCommand(ctx, k.host, urn, cmd)
-		k.loginLock.Unlock()
-		if err != nil {
-			return nil, fmt.Errorf("docker login failed: %w", err)
-		}
-	}
-
-	var platforms []string
-	for _, v := range inputs["platforms"].ArrayValue() {
-		platforms = append(platforms, v.StringValue())
-	}
-
-	var arguments []string = []string{
-		"buildx", "build",
-		"--platform", strings.Join(platforms, ","),
-		"--cache-from", name,
-		"--cache-to", "type=inline",
-		"-f", filepath.Join(context, dockerfile),
-		"--target", target,
-		"-t", name, "--push",
-	}
-
-	if !inputs["args"].IsNull() {
-		for _, v := range inputs["args"].ArrayValue() {
-			arguments = append(arguments, "--build-arg")
-			arguments = append(arguments, fmt.Sprintf("%s=%s", v.ObjectValue()["key"].StringValue(), v.ObjectValue()["value"].StringValue()))
-		}
-	}
-
-	arguments = append(arguments, context)
-
-	cmd := exec.Command(
-		"docker", arguments...,
-	)
-	if err := runCommand(ctx, k.host, urn, cmd); err != nil {
-		return nil, fmt.Errorf("docker build failed: %w", err)
-	}
-
-	cmd = exec.Command("docker", "inspect", name, "-f", `{{join .RepoDigests "\n"}}`)
-	repoDigests, err := cmd.CombinedOutput()
-	if err != nil {
-		return nil, fmt.Errorf("docker inspect failed: %s: %s", err, string(repoDigests))
-	}
-	var repoDigest string
-	for _, line := range strings.Split(string(repoDigests), "\n") {
-		repo := strings.Split(line, "@")[0]
-		if repo == baseName {
-			repoDigest = line
-			break
-		}
-	}
-	if repoDigest == "" {
-		return nil, fmt.Errorf("failed to find repo digest in docker inspect output: %s", repoDigests)
-	}
-
-	outputs := map[string]interface{}{
-		"dockerfile":     dockerfile,
-		"context":        context,
-		"target":         target,
-		"name":           name,
-		"platforms":      platforms,
-		"contextDigest":  contextDigest,
-		"repoDigest":     repoDigest,
-		"registryServer": registry["server"].StringValue(),
-	}
-	return plugin.MarshalProperties(
-		resource.NewPropertyMapFromMap(outputs),
-		plugin.MarshalOptions{KeepUnknowns: true, SkipNulls: true},
-	)
-}
-
 func applyDefaults(inputs resource.PropertyMap) {
 	if inputs["platforms"].IsNull() {
 		inputs["platforms"] = resource.NewArrayProperty(
 			[]resource.PropertyValue{resource.NewStringProperty("linux/amd64")},
 		)
 	}
-}
-
-func runCommand(
-	ctx context.Context,
-	host *provider.HostClient,
-	urn resource.URN,
-	cmd *exec.Cmd,
-) error {
-	cmd.Stdout = &logWriter{
-		ctx:      ctx,
-		host:     host,
-		urn:      urn,
-		severity: diag.Info,
-	}
-	cmd.Stderr = &logWriter{
-		ctx:      ctx,
-		host:     host,
-		urn:      urn,
-		severity: diag.Info,
+	if inputs["buildkitHost"].IsNull() {
+		inputs["buildkitHost"] = resource.NewStringProperty(defaultBuildkitHost)
 	}
-	return cmd.Run()
-}
-
-type logWriter struct {
-	ctx      context.Context
-	host     *provider.HostClient
-	urn      resource.URN
-	severity diag.Severity
-}
-
-func (w *logWriter) Write(p []byte) (n int, err error) {
-	return len(p), w.host.Log(w.ctx, w.severity, w.urn, string(p))
-}
-
-type contextHash struct {
-	contextPath string
-	input       bytes.Buffer
-}
-
-func newContextHash(contextPath string) *contextHash {
-	return &contextHash{contextPath: contextPath}
-}
-
-func (ch *contextHash) hashPath(path string, fileMode fs.FileMode) error {
-	f, err := os.Open(filepath.Join(ch.contextPath, path))
-	if err != nil {
-		return fmt.Errorf("open %s: %w", path, err)
-	}
-	defer f.Close()
-	h := sha256.New()
-	_, err = io.Copy(h, f)
-	if err != nil {
-		return fmt.Errorf("read %s: %w", path, err)
-	}
-	ch.input.Write([]byte(path))
-	ch.input.Write([]byte(fileMode.String()))
-	ch.input.Write(h.Sum(nil))
-	ch.input.WriteByte(0)
-	return nil
-}
-
-func (ch *contextHash) hexSum() string {
-	h := sha256.New()
-	ch.input.WriteTo(h)
-	return hex.EncodeToString(h.Sum(nil))
-}
-
-func hashContext(contextPath string, dockerfile string) (string, error) {
-	dockerIgnorePath := dockerfile + ".dockerignore"
-	dockerIgnore, err := os.ReadFile(dockerIgnorePath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			dockerIgnorePath = filepath.Join(contextPath, ".dockerignore")
-			dockerIgnore, err = os.ReadFile(dockerIgnorePath)
-			if err != nil && !os.IsNotExist(err) {
-				return "", fmt.Errorf("unable to read %s file: %w", dockerIgnorePath, err)
-			}
-		} else {
-			return "", fmt.Errorf("unable to read %s file: %w", dockerIgnorePath, err)
-		}
-	}
-	ignorePatterns, err := dockerignore.ReadAll(bytes.NewReader(dockerIgnore))
-	if err != nil {
-		return "", fmt.Errorf("unable to parse %s file: %w", dockerIgnorePath, err)
-	}
-	ignoreMatcher, err := fileutils.NewPatternMatcher(ignorePatterns)
-	if err != nil {
-		return "", fmt.Errorf("unable to load rules from %s: %w", dockerIgnorePath, err)
-	}
-	ch := newContextHash(contextPath)
-	err = ch.hashPath(dockerfile, 0)
-	if err != nil {
-		return "", fmt.Errorf("hashing dockerfile %q: %w", dockerfile, err)
-	}
-	err = filepath.WalkDir(contextPath, func(path string, d os.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-		path, err = filepath.Rel(contextPath, path)
-		if err != nil {
-			return err
-		}
-		if path == "." {
-			return nil
-		}
-		ignore, err := ignoreMatcher.Matches(path)
-		if err != nil {
-			return fmt.Errorf("%s rule failed: %w", dockerIgnorePath, err)
-		}
-		if ignore {
-			if d.IsDir() {
-				return filepath.SkipDir
-			} else {
-				return nil
-			}
-		} else if d.IsDir() {
-			return nil
-		}
-		info, err := d.Info()
-		if err != nil {
-			return fmt.Errorf("determining mode for %q: %w", path, err)
-		}
-		err = ch.hashPath(path, info.Mode())
-		if err != nil {
-			return fmt.Errorf("hashing %q: %w", path, err)
-		}
-		return nil
-	})
-	if err != nil {
-		return "", fmt.Errorf("unable to hash build context: %w", err)
+	if inputs["skipDelete"].IsNull() {
+		inputs["skipDelete"] = resource.NewBoolProperty(false)
 	}
-	return ch.hexSum(), nil
 }
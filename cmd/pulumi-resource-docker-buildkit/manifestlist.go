@@ -0,0 +1,116 @@
+// Copyright 2016-2020, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/reference"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/plugin"
+)
+
+// manifestListPublish assembles a multi-arch OCI image index / Docker
+// manifest list from a set of already-pushed per-arch images and publishes
+// it under the given tag, so that per-arch images built independently (for
+// example on separate native runners) can be stitched together without
+// rebuilding them.
+func (k *dockerBuildkitProvider) manifestListPublish(
+	ctx context.Context,
+	urn resource.URN,
+	props *structpb.Struct,
+) (*structpb.Struct, error) {
+	inputs, err := plugin.UnmarshalProperties(props, plugin.MarshalOptions{KeepUnknowns: true, SkipNulls: true})
+	if err != nil {
+		return nil, err
+	}
+	name := inputs["name"].StringValue()
+	registry := inputs["registry"].ObjectValue()
+
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %q: %w", name, err)
+	}
+	tagged, ok := named.(reference.NamedTagged)
+	if !ok {
+		return nil, fmt.Errorf("%q must include a tag", name)
+	}
+
+	username, password, _, err := resolveRegistryCredentials(registry)
+	if err != nil {
+		return nil, fmt.Errorf("resolving registry credentials: %w", err)
+	}
+
+	repoClient, err := newRegistryClient(
+		ctx,
+		registry["server"].StringValue(),
+		reference.Path(named),
+		username,
+		password,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to registry: %w", err)
+	}
+
+	images := inputs["images"].ArrayValue()
+	descriptors := make([]manifestlist.ManifestDescriptor, len(images))
+	for i, v := range images {
+		image := v.ObjectValue()
+		dgst := digest.Digest(image["digest"].StringValue())
+		platform := image["platform"].StringValue()
+
+		desc, err := repoClient.headManifest(ctx, dgst)
+		if err != nil {
+			return nil, fmt.Errorf("fetching manifest %s: %w", dgst, err)
+		}
+
+		parts := strings.SplitN(platform, "/", 3)
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("invalid platform %q, expected os/arch[/variant]", platform)
+		}
+		platformSpec := manifestlist.PlatformSpec{OS: parts[0], Architecture: parts[1]}
+		if len(parts) == 3 {
+			platformSpec.Variant = parts[2]
+		}
+
+		descriptors[i] = manifestlist.ManifestDescriptor{
+			Descriptor: desc,
+			Platform:   platformSpec,
+		}
+	}
+
+	list, err := manifestlist.FromDescriptors(descriptors)
+	if err != nil {
+		return nil, fmt.Errorf("assembling manifest list: %w", err)
+	}
+
+	repoDigest, err := repoClient.putManifest(ctx, tagged.Tag(), list)
+	if err != nil {
+		return nil, fmt.Errorf("publishing manifest list: %w", err)
+	}
+
+	outputs := resource.PropertyMap{
+		"name":           resource.NewStringProperty(name),
+		"images":         inputs["images"],
+		"repoDigest":     resource.NewStringProperty(fmt.Sprintf("%s@%s", reference.Path(named), repoDigest)),
+		"registryServer": resource.NewStringProperty(registry["server"].StringValue()),
+	}
+	return plugin.MarshalProperties(outputs, plugin.MarshalOptions{KeepUnknowns: true, SkipNulls: true})
+}
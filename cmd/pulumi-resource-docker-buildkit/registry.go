@@ -0,0 +1,270 @@
+// Copyright 2016-2020, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/reference"
+	v2 "github.com/docker/distribution/registry/api/v2"
+	"github.com/docker/distribution/registry/client/auth"
+	"github.com/docker/distribution/registry/client/auth/challenge"
+	"github.com/docker/distribution/registry/client/transport"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// errDeleteUnsupported is returned by deleteManifest when the registry
+// declines to delete manifests at all, as Docker Hub does.
+var errDeleteUnsupported = errors.New("registry does not support manifest deletion")
+
+// registryClient is a minimal client for the parts of the Docker/OCI
+// registry v2 HTTP API that this provider needs: HEADing and PUTing
+// manifests within a single repository. It authenticates lazily against
+// whatever challenge (HTTP Basic or Bearer token) the registry returns,
+// the same way the Docker CLI does.
+type registryClient struct {
+	repo   reference.Named
+	ub     *v2.URLBuilder
+	client *http.Client
+}
+
+// staticCredentialStore implements auth.CredentialStore with a single fixed
+// username and password, supplied directly on the resource.
+type staticCredentialStore struct {
+	username string
+	password string
+}
+
+func (s staticCredentialStore) Basic(*url.URL) (string, string) {
+	return s.username, s.password
+}
+
+func (s staticCredentialStore) RefreshToken(*url.URL, string) string {
+	return ""
+}
+
+func (s staticCredentialStore) SetRefreshToken(*url.URL, string, string) {}
+
+// canonicalRegistryHost maps a reference domain to the host that actually
+// serves its v2 API. Docker Hub is the one registry where these differ:
+// references normalize to the "docker.io"/"index.docker.io" domain (and
+// that's still what credential lookups are keyed on), but the v2 API is
+// served from registry-1.docker.io, not docker.io itself. This is the same
+// special case the Docker CLI and containerd apply when resolving a
+// registry host to talk to.
+func canonicalRegistryHost(domain string) string {
+	switch domain {
+	case "docker.io", "index.docker.io":
+		return "registry-1.docker.io"
+	default:
+		return domain
+	}
+}
+
+// newRegistryClient pings server to discover its authentication challenge,
+// then builds an authenticated client scoped to repoPath.
+func newRegistryClient(ctx context.Context, server, repoPath, username, password string) (*registryClient, error) {
+	repo, err := reference.WithName(repoPath)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository name %q: %w", repoPath, err)
+	}
+
+	baseURL := "https://" + canonicalRegistryHost(server)
+	pingReq, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+"/v2/", nil)
+	if err != nil {
+		return nil, err
+	}
+	pingResp, err := http.DefaultClient.Do(pingReq)
+	if err != nil {
+		return nil, fmt.Errorf("pinging %s: %w", server, err)
+	}
+	defer pingResp.Body.Close()
+
+	manager := challenge.NewSimpleManager()
+	if err := manager.AddResponse(pingResp); err != nil {
+		return nil, fmt.Errorf("parsing authentication challenge from %s: %w", server, err)
+	}
+
+	creds := staticCredentialStore{username: username, password: password}
+	authorizer := auth.NewAuthorizer(
+		manager,
+		auth.NewTokenHandler(http.DefaultTransport, creds, repoPath, "pull", "push"),
+		auth.NewBasicHandler(creds),
+	)
+
+	ub, err := v2.NewURLBuilderFromString(baseURL, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &registryClient{
+		repo: repo,
+		ub:   ub,
+		client: &http.Client{
+			Transport: transport.NewTransport(http.DefaultTransport, authorizer),
+		},
+	}, nil
+}
+
+// headManifest issues an HTTP HEAD against the manifest addressed by dgst
+// and builds a descriptor from the response headers, without downloading
+// the manifest body.
+func (r *registryClient) headManifest(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
+	ref, err := reference.WithDigest(r.repo, dgst)
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	return r.headManifestRef(ctx, ref, dgst)
+}
+
+// headManifestTag is headManifest for a manifest addressed by tag instead of
+// digest, e.g. a cosign signature manifest.
+func (r *registryClient) headManifestTag(ctx context.Context, tag string) (distribution.Descriptor, error) {
+	ref, err := reference.WithTag(r.repo, tag)
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	return r.headManifestRef(ctx, ref, "")
+}
+
+// headManifestRef is the shared implementation behind headManifest and
+// headManifestTag. fallbackDigest is used when the registry's response
+// doesn't include a Docker-Content-Digest header.
+func (r *registryClient) headManifestRef(ctx context.Context, ref reference.Named, fallbackDigest digest.Digest) (distribution.Descriptor, error) {
+	u, err := r.ub.BuildManifestURL(ref)
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u, nil)
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	for _, mediaType := range distribution.ManifestMediaTypes() {
+		req.Header.Add("Accept", mediaType)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return distribution.Descriptor{}, fmt.Errorf("HEAD %s: unexpected status %s", u, resp.Status)
+	}
+
+	contentDigest := digest.Digest(resp.Header.Get("Docker-Content-Digest"))
+	if contentDigest == "" {
+		contentDigest = fallbackDigest
+	}
+	size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return distribution.Descriptor{}, fmt.Errorf("parsing Content-Length header: %w", err)
+	}
+
+	return distribution.Descriptor{
+		MediaType: resp.Header.Get("Content-Type"),
+		Digest:    contentDigest,
+		Size:      size,
+	}, nil
+}
+
+// putManifest PUTs m under tag and returns the digest the registry assigns
+// to the pushed content.
+func (r *registryClient) putManifest(ctx context.Context, tag string, m distribution.Manifest) (digest.Digest, error) {
+	ref, err := reference.WithTag(r.repo, tag)
+	if err != nil {
+		return "", err
+	}
+	u, err := r.ub.BuildManifestURL(ref)
+	if err != nil {
+		return "", err
+	}
+
+	mediaType, payload, err := m.Payload()
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u, bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", mediaType)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("PUT %s: unexpected status %s: %s", u, resp.Status, body)
+	}
+
+	if contentDigest := resp.Header.Get("Docker-Content-Digest"); contentDigest != "" {
+		return digest.Digest(contentDigest), nil
+	}
+	return digest.FromBytes(payload), nil
+}
+
+// deleteManifest issues an HTTP DELETE against the manifest addressed by
+// dgst. It returns errDeleteUnsupported if the registry responds that it
+// does not support deletion (405 Method Not Allowed, or an UNSUPPORTED
+// error code in the response body), which registries like Docker Hub do
+// unless storage deletion is explicitly enabled.
+func (r *registryClient) deleteManifest(ctx context.Context, dgst digest.Digest) error {
+	ref, err := reference.WithDigest(r.repo, dgst)
+	if err != nil {
+		return err
+	}
+	u, err := r.ub.BuildManifestURL(ref)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, u, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusMethodNotAllowed {
+		return errDeleteUnsupported
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		if bytes.Contains(body, []byte("UNSUPPORTED")) {
+			return errDeleteUnsupported
+		}
+		return fmt.Errorf("DELETE %s: unexpected status %s: %s", u, resp.Status, body)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2016-2020, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+)
+
+// signArgs is the parsed form of the Image resource's sign input.
+type signArgs struct {
+	provider    string
+	keyRef      string
+	keyless     bool
+	fulcioURL   string
+	rekorURL    string
+	annotations map[string]string
+}
+
+// parseSignArgs parses the sign input property. ok is false if the property
+// is unset, meaning signing is disabled.
+func parseSignArgs(v resource.PropertyValue) (args signArgs, ok bool) {
+	if v.IsNull() {
+		return signArgs{}, false
+	}
+	obj := v.ObjectValue()
+	args.provider = obj["provider"].StringValue()
+	if keyRef := obj["keyRef"]; !keyRef.IsNull() {
+		args.keyRef = keyRef.StringValue()
+	}
+	if keyless := obj["keyless"]; !keyless.IsNull() {
+		args.keyless = keyless.BoolValue()
+	}
+	if fulcioURL := obj["fulcioURL"]; !fulcioURL.IsNull() {
+		args.fulcioURL = fulcioURL.StringValue()
+	}
+	if rekorURL := obj["rekorURL"]; !rekorURL.IsNull() {
+		args.rekorURL = rekorURL.StringValue()
+	}
+	if annotations := obj["annotations"]; !annotations.IsNull() {
+		args.annotations = map[string]string{}
+		for key, value := range annotations.ObjectValue() {
+			args.annotations[string(key)] = value.StringValue()
+		}
+	}
+	return args, true
+}
+
+// signImage signs repoDigest (never the mutable tag) with cosign and returns
+// the digest of the signature manifest cosign publishes alongside the image,
+// so that downstream resources (e.g. a Kubernetes admission policy via
+// cosigned) can verify against it.
+func (k *dockerBuildkitProvider) signImage(
+	ctx context.Context,
+	urn resource.URN,
+	registry resource.PropertyMap,
+	repoDigest string,
+	args signArgs,
+) (string, error) {
+	if args.provider != "cosign" {
+		return "", fmt.Errorf("unsupported sign provider %q", args.provider)
+	}
+
+	cmdArgs := []string{"sign", "--yes"}
+	if args.keyRef != "" {
+		cmdArgs = append(cmdArgs, "--key", args.keyRef)
+	}
+	if args.fulcioURL != "" {
+		cmdArgs = append(cmdArgs, "--fulcio-url", args.fulcioURL)
+	}
+	if args.rekorURL != "" {
+		cmdArgs = append(cmdArgs, "--rekor-url", args.rekorURL)
+	}
+	for key, value := range args.annotations {
+		cmdArgs = append(cmdArgs, "-a", fmt.Sprintf("%s=%s", key, value))
+	}
+	cmdArgs = append(cmdArgs, repoDigest)
+
+	cmd := exec.CommandContext(ctx, "cosign", cmdArgs...)
+	if args.keyless {
+		// cosign gates keyless signing behind this flag, detecting an
+		// ambient OIDC identity (GitHub Actions, GCP, ...) on its own.
+		cmd.Env = append(os.Environ(), "COSIGN_EXPERIMENTAL=1")
+	}
+	if err := runCommand(ctx, k.host, urn, cmd); err != nil {
+		return "", fmt.Errorf("cosign sign failed: %w", err)
+	}
+
+	named, dgst, err := parseRepoDigest(repoDigest)
+	if err != nil {
+		return "", err
+	}
+
+	username, password, _, err := resolveRegistryCredentials(registry)
+	if err != nil {
+		return "", fmt.Errorf("resolving registry credentials: %w", err)
+	}
+	repoClient, err := newRegistryClient(ctx, registry["server"].StringValue(), reference.Path(named), username, password)
+	if err != nil {
+		return "", fmt.Errorf("connecting to registry: %w", err)
+	}
+
+	// cosign publishes the signature as a manifest tagged with the image
+	// digest, algorithm separator replaced with a dash, plus a .sig suffix.
+	sigTag := strings.Replace(dgst.String(), ":", "-", 1) + ".sig"
+	desc, err := repoClient.headManifestTag(ctx, sigTag)
+	if err != nil {
+		return "", fmt.Errorf("fetching signature manifest %s: %w", sigTag, err)
+	}
+	return fmt.Sprintf("%s@%s", reference.Path(named), desc.Digest), nil
+}
@@ -48,6 +48,16 @@ func run(version string) error {
 		Repository:        "https://github.com/MaterializeInc/pulumi-docker-buildkit",
 		PluginDownloadURL: fmt.Sprintf("https://github.com/MaterializeInc/pulumi-docker-buildkit/releases/download/v%s/", version),
 		Provider:          schema.ResourceSpec{},
+		Config: schema.ConfigSpec{
+			Variables: map[string]schema.PropertySpec{
+				"contextHashConcurrency": {
+					Description: "The number of workers used to hash build context files in " +
+						"parallel. Defaults to the number of CPUs available; dial it down on " +
+						"slow NFS mounts where concurrent reads hurt more than they help.",
+					TypeSpec: schema.TypeSpec{Type: "integer"},
+				},
+			},
+		},
 		Resources: map[string]schema.ResourceSpec{
 			"docker-buildkit:index:Image": {
 				ObjectTypeSpec: schema.ObjectTypeSpec{
@@ -88,11 +98,51 @@ func run(version string) error {
 							Description: "The name of the target stage to build in the Dockerfile.",
 							TypeSpec:    schema.TypeSpec{Type: "string"},
 						},
+						"buildkitHost": {
+							Description: "The address of the buildkitd instance to build with.",
+							TypeSpec:    schema.TypeSpec{Type: "string"},
+						},
+						"skipDelete": {
+							Description: "If true, `pulumi destroy` leaves the image in the registry " +
+								"instead of deleting it.",
+							TypeSpec: schema.TypeSpec{Type: "boolean"},
+						},
+						"cacheFrom": {
+							Description: "The cache sources to import build cache from.",
+							TypeSpec: schema.TypeSpec{
+								Type:  "array",
+								Items: &schema.TypeSpec{Ref: "#/types/docker-buildkit:index:CacheOption"},
+							},
+						},
+						"cacheTo": {
+							Description: "The cache exporters to export build cache to.",
+							TypeSpec: schema.TypeSpec{
+								Type:  "array",
+								Items: &schema.TypeSpec{Ref: "#/types/docker-buildkit:index:CacheOption"},
+							},
+						},
+						"additionalContexts": {
+							Description: "Additional named build contexts, keyed by the name used in " +
+								"`FROM --from=name` / `COPY --from=name`.",
+							TypeSpec: schema.TypeSpec{
+								Type:                 "object",
+								AdditionalProperties: &schema.TypeSpec{Type: "string"},
+							},
+						},
+						"sign": {
+							Description: "The signing configuration used to sign the pushed image.",
+							TypeSpec:    schema.TypeSpec{Ref: "#/types/docker-buildkit:index:Sign"},
+						},
+						"signatureDigest": {
+							Description: "The digest of the published signature manifest, set only " +
+								"when `sign` is configured.",
+							TypeSpec: schema.TypeSpec{Type: "string"},
+						},
 					},
 					Required: []string{
 						"dockerfile", "context", "name", "platforms",
 						"contextDigest", "repoDigest", "registryServer",
-						"target",
+						"target", "buildkitHost", "skipDelete",
 					},
 				},
 				InputProperties: map[string]schema.PropertySpec{
@@ -128,6 +178,13 @@ func run(version string) error {
 						TypeSpec:    schema.TypeSpec{Type: "string"},
 						Default:     "",
 					},
+					"buildkitHost": {
+						Description: "The address of the buildkitd instance to build with. Accepts " +
+							"`unix://`, `tcp://`, `docker-container://`, and `kube-pod://` addresses. " +
+							"Defaults to the local system buildkitd socket.",
+						TypeSpec: schema.TypeSpec{Type: "string"},
+						Default:  "unix:///run/buildkit/buildkitd.sock",
+					},
 					"args": {
 						Description: "The build args.",
 						TypeSpec: schema.TypeSpec{
@@ -137,9 +194,119 @@ func run(version string) error {
 							},
 						},
 					},
+					"skipDelete": {
+						Description: "If true, `pulumi destroy` leaves the image in the registry " +
+							"instead of deleting it. Useful for registries like Docker Hub where " +
+							"storage reclamation isn't wanted, or isn't supported.",
+						TypeSpec: schema.TypeSpec{Type: "boolean"},
+						Default:  false,
+					},
+					"cacheFrom": {
+						Description: "The cache sources to import build cache from, e.g. " +
+							"`{ type: \"registry\", params: { ref: \"...\" } }`. Supported types " +
+							"include `registry`, `local`, `inline`, `gha`, and `s3`.",
+						TypeSpec: schema.TypeSpec{
+							Type:  "array",
+							Items: &schema.TypeSpec{Ref: "#/types/docker-buildkit:index:CacheOption"},
+						},
+					},
+					"cacheTo": {
+						Description: "The cache exporters to export build cache to, e.g. " +
+							"`{ type: \"inline\" }`. Supported types include `registry`, `local`, " +
+							"`inline`, `gha`, and `s3`.",
+						TypeSpec: schema.TypeSpec{
+							Type:  "array",
+							Items: &schema.TypeSpec{Ref: "#/types/docker-buildkit:index:CacheOption"},
+						},
+					},
+					"secrets": {
+						Description: "Secrets to expose to `RUN --mount=type=secret,id=...` mounts. " +
+							"A secret with a literal `value` is materialized to a temporary file " +
+							"that is removed once the build finishes.",
+						TypeSpec: schema.TypeSpec{
+							Type:  "array",
+							Items: &schema.TypeSpec{Ref: "#/types/docker-buildkit:index:Secret"},
+						},
+					},
+					"sshSockets": {
+						Description: "SSH agent sockets or keys to expose to `RUN --mount=type=ssh` mounts.",
+						TypeSpec: schema.TypeSpec{
+							Type:  "array",
+							Items: &schema.TypeSpec{Ref: "#/types/docker-buildkit:index:SSHSocket"},
+						},
+					},
+					"additionalContexts": {
+						Description: "Additional named build contexts, keyed by the name used in " +
+							"`FROM --from=name` / `COPY --from=name`. Values can be a local path, a " +
+							"git URL, an OCI image reference (`docker-image://...`), or an HTTP URL. " +
+							"Local-path and OCI-image contexts contribute to `contextDigest`, so edits " +
+							"to a shared directory or a moved image tag trigger a rebuild.",
+						TypeSpec: schema.TypeSpec{
+							Type:                 "object",
+							AdditionalProperties: &schema.TypeSpec{Type: "string"},
+						},
+					},
+					"sign": {
+						Description: "If set, signs the pushed image's repoDigest with " +
+							"sigstore/cosign after a successful push. Changing the key or policy " +
+							"triggers re-signing.",
+						TypeSpec: schema.TypeSpec{Ref: "#/types/docker-buildkit:index:Sign"},
+					},
 				},
 				RequiredInputs: []string{"name", "registry"},
 			},
+			"docker-buildkit:index:ManifestList": {
+				ObjectTypeSpec: schema.ObjectTypeSpec{
+					Description: "Composes per-architecture images into a multi-arch OCI image index " +
+						"(manifest list) and pushes it to a registry.",
+					Properties: map[string]schema.PropertySpec{
+						"name": {
+							Description: "The name of the manifest list, including its tag.",
+							TypeSpec:    schema.TypeSpec{Type: "string"},
+						},
+						"images": {
+							Description: "The per-architecture images to compose into the manifest list.",
+							TypeSpec: schema.TypeSpec{
+								Type: "array",
+								Items: &schema.TypeSpec{
+									Ref: "#/types/docker-buildkit:index:ManifestListImage",
+								},
+							},
+						},
+						"repoDigest": {
+							Description: "The digest of the manifest list in the registry.",
+							TypeSpec:    schema.TypeSpec{Type: "string"},
+						},
+						"registryServer": {
+							Description: "The URL of the registry server hosting the manifest list.",
+							TypeSpec:    schema.TypeSpec{Type: "string"},
+						},
+					},
+					Required: []string{"name", "images", "repoDigest", "registryServer"},
+				},
+				InputProperties: map[string]schema.PropertySpec{
+					"name": {
+						Description: "The name of the manifest list, including its tag.",
+						TypeSpec:    schema.TypeSpec{Type: "string"},
+					},
+					"images": {
+						Description: "The per-architecture images to compose into the manifest list.",
+						TypeSpec: schema.TypeSpec{
+							Type: "array",
+							Items: &schema.TypeSpec{
+								Ref: "#/types/docker-buildkit:index:ManifestListImage",
+							},
+						},
+					},
+					"registry": {
+						Description: "The registry to push the manifest list to.",
+						TypeSpec: schema.TypeSpec{
+							Ref: "#/types/docker-buildkit:index:Registry",
+						},
+					},
+				},
+				RequiredInputs: []string{"name", "images", "registry"},
+			},
 		},
 		Types: map[string]schema.ComplexTypeSpec{
 			"docker-buildkit:index:Registry": {
@@ -159,6 +326,14 @@ func run(version string) error {
 							Description: "The password to authenticate with.",
 							TypeSpec:    schema.TypeSpec{Type: "string"},
 						},
+						"credentialHelper": {
+							Description: "The name of a Docker credential helper to resolve credentials " +
+								"from, invoked as `docker-credential-<credentialHelper>` (e.g. " +
+								"`ecr-login`, `gcr`, `acr-env`). Takes precedence over the ambient " +
+								"`~/.docker/config.json` credsStore/credHelpers, but not over an " +
+								"explicit username/password.",
+							TypeSpec: schema.TypeSpec{Type: "string"},
+						},
 					},
 					Required: []string{"server"},
 				},
@@ -180,6 +355,136 @@ func run(version string) error {
 					Required: []string{"key", "value"},
 				},
 			},
+			"docker-buildkit:index:CacheOption": {
+				ObjectTypeSpec: schema.ObjectTypeSpec{
+					Description: "Describes a BuildKit cache importer or exporter, matching the " +
+						"`--cache-from`/`--cache-to type=...,key=value` CLI syntax.",
+					Type: "object",
+					Properties: map[string]schema.PropertySpec{
+						"type": {
+							Description: "The cache backend, e.g. `registry`, `local`, `inline`, `gha`, or `s3`.",
+							TypeSpec:    schema.TypeSpec{Type: "string"},
+						},
+						"params": {
+							Description: "Backend-specific parameters, e.g. `ref` for the `registry` backend.",
+							TypeSpec: schema.TypeSpec{
+								Type:                 "object",
+								AdditionalProperties: &schema.TypeSpec{Type: "string"},
+							},
+						},
+					},
+					Required: []string{"type"},
+				},
+			},
+			"docker-buildkit:index:Secret": {
+				ObjectTypeSpec: schema.ObjectTypeSpec{
+					Description: "Describes a secret exposed to `RUN --mount=type=secret,id=...`. " +
+						"Exactly one of `value`, `path`, or `env` should be set; if none are set, " +
+						"the id is used to look up an environment variable of the same name, " +
+						"falling back to a local file of the same name.",
+					Type: "object",
+					Properties: map[string]schema.PropertySpec{
+						"id": {
+							Description: "The secret id referenced by `--mount=type=secret,id=...`.",
+							TypeSpec:    schema.TypeSpec{Type: "string"},
+						},
+						"value": {
+							Description: "A literal secret value, written to a 0600 temporary file for " +
+								"the duration of the build.",
+							TypeSpec: schema.TypeSpec{Type: "string"},
+							Secret:   true,
+						},
+						"path": {
+							Description: "The path to a local file containing the secret.",
+							TypeSpec:    schema.TypeSpec{Type: "string"},
+						},
+						"env": {
+							Description: "The name of an environment variable containing the secret.",
+							TypeSpec:    schema.TypeSpec{Type: "string"},
+						},
+					},
+					Required: []string{"id"},
+				},
+			},
+			"docker-buildkit:index:SSHSocket": {
+				ObjectTypeSpec: schema.ObjectTypeSpec{
+					Description: "Describes an SSH agent socket or key exposed to " +
+						"`RUN --mount=type=ssh`, matching the `--ssh id=foo[=path1,path2]` CLI syntax.",
+					Type: "object",
+					Properties: map[string]schema.PropertySpec{
+						"id": {
+							Description: "The ssh id referenced by `--mount=type=ssh,id=...`.",
+							TypeSpec:    schema.TypeSpec{Type: "string"},
+						},
+						"paths": {
+							Description: "The paths to agent sockets or keys. Defaults to " +
+								"`$SSH_AUTH_SOCK` when unset.",
+							TypeSpec: schema.TypeSpec{
+								Type:  "array",
+								Items: &schema.TypeSpec{Type: "string"},
+							},
+						},
+					},
+					Required: []string{"id"},
+				},
+			},
+			"docker-buildkit:index:Sign": {
+				ObjectTypeSpec: schema.ObjectTypeSpec{
+					Description: "Describes how to sign a pushed image with sigstore/cosign.",
+					Type:        "object",
+					Properties: map[string]schema.PropertySpec{
+						"provider": {
+							Description: "The signing provider. Currently only `cosign` is supported.",
+							TypeSpec:    schema.TypeSpec{Type: "string"},
+						},
+						"keyRef": {
+							Description: "A cosign key reference, e.g. `cosign.key` or " +
+								"`awskms:///alias/my-key`. Mutually exclusive with `keyless`.",
+							TypeSpec: schema.TypeSpec{Type: "string"},
+						},
+						"keyless": {
+							Description: "If true, sign keylessly using cosign's ambient OIDC " +
+								"identity detection (GitHub Actions, GCP, ...) against Fulcio and Rekor.",
+							TypeSpec: schema.TypeSpec{Type: "boolean"},
+						},
+						"fulcioURL": {
+							Description: "The Fulcio CA URL to use for keyless signing. Defaults to " +
+								"cosign's public instance.",
+							TypeSpec: schema.TypeSpec{Type: "string"},
+						},
+						"rekorURL": {
+							Description: "The Rekor transparency log URL to use for keyless signing. " +
+								"Defaults to cosign's public instance.",
+							TypeSpec: schema.TypeSpec{Type: "string"},
+						},
+						"annotations": {
+							Description: "Annotations to attach to the signature.",
+							TypeSpec: schema.TypeSpec{
+								Type:                 "object",
+								AdditionalProperties: &schema.TypeSpec{Type: "string"},
+							},
+						},
+					},
+					Required: []string{"provider"},
+				},
+			},
+			"docker-buildkit:index:ManifestListImage": {
+				ObjectTypeSpec: schema.ObjectTypeSpec{
+					Description: "Describes a single per-architecture image included in a manifest list.",
+					Type:        "object",
+					Properties: map[string]schema.PropertySpec{
+						"digest": {
+							Description: "The digest of the image manifest in the registry, e.g. `sha256:...`.",
+							TypeSpec:    schema.TypeSpec{Type: "string"},
+						},
+						"platform": {
+							Description: "The platform the image was built for, as `os/arch` or `os/arch/variant`.",
+							TypeSpec:    schema.TypeSpec{Type: "string"},
+						},
+					},
+					Required: []string{"digest", "platform"},
+				},
+			},
 		},
 		Language: map[string]schema.RawMessage{
 			"python": schema.RawMessage("{}"),